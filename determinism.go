@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"strconv"
+)
+
+var seed = flag.Int64("seed", 0, "seed for deterministic fault-site selection; the same seed always faults the same sites, which makes a run reproducible")
+
+// shouldFaultFuncName is the name of the generated per-package function
+// that decides, at runtime, whether a given injection site should fire.
+const shouldFaultFuncName = "_errorsmith_shouldFault"
+
+// siteID derives a stable ID for an injection site from its source location
+// and a counter scoped to the enclosing function, so the same site gets the
+// same ID across repeated runs of errorsmith as long as the source around
+// it doesn't change.
+func siteID(file string, line, col int, funcName string, counter int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(file))
+	h.Write([]byte(":"))
+	h.Write([]byte(funcName))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.Itoa(line)))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.Itoa(col)))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.Itoa(counter)))
+	return h.Sum64()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+)
+
+var diffFlag = flag.Bool("diff", false, "print a unified diff of each file's original and injected source to stderr")
+
+// unifiedDiff renders a unified diff between original and transformed,
+// labeled with fromFile/toFile, in the style printed by `diff -u` and
+// `gofmt -d`. Unlike those, it's always a single hunk covering the whole
+// file rather than windowed hunks around each change: for reviewing
+// errorsmith's own injected faults, simplicity beats a minimal patch.
+func unifiedDiff(fromFile, toFile string, original, transformed []byte) string {
+	fromLines := splitLines(original)
+	toLines := splitLines(transformed)
+	ops := diffLines(fromLines, toLines)
+	if allEqual(ops) {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n", fromFile)
+	fmt.Fprintf(&buf, "+++ %s\n", toFile)
+	fmt.Fprintf(&buf, "@@ -1,%d +1,%d @@\n", len(fromLines), len(toLines))
+	for _, op := range ops {
+		switch op.kind {
+		case opEqual:
+			buf.WriteString(" " + op.text)
+		case opDelete:
+			buf.WriteString("-" + op.text)
+		case opInsert:
+			buf.WriteString("+" + op.text)
+		}
+	}
+	return buf.String()
+}
+
+type diffOpKind int
+
+const (
+	opEqual diffOpKind = iota
+	opDelete
+	opInsert
+)
+
+type diffOp struct {
+	kind diffOpKind
+	text string
+}
+
+func allEqual(ops []diffOp) bool {
+	for _, op := range ops {
+		if op.kind != opEqual {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLines splits content into lines, keeping each line's trailing
+// newline so the diff can be printed back out verbatim.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	var lines []string
+	start := 0
+	for i, b := range content {
+		if b == '\n' {
+			lines = append(lines, string(content[start:i+1]))
+			start = i + 1
+		}
+	}
+	if start < len(content) {
+		lines = append(lines, string(content[start:])+"\n")
+	}
+	return lines
+}
+
+// diffLines computes a line-level diff via the classic longest-common-
+// subsequence dynamic program, then backtracks it into a flat op sequence.
+func diffLines(from, to []string) []diffOp {
+	n, m := len(from), len(to)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case from[i] == to[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case from[i] == to[j]:
+			ops = append(ops, diffOp{opEqual, from[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{opDelete, from[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{opInsert, to[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{opDelete, from[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{opInsert, to[j]})
+	}
+	return ops
+}
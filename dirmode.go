@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// injectPackage loads every .go file in dir as a single package, via
+// parser.ParseDir, and runs transformFile over each of them, writing each
+// result back to its own path plus one shared runtime support file for the
+// package. root is the base that -o mirrors dir's path under, so that
+// injecting a ./... pattern spanning several packages doesn't flatten them
+// all into the same -o directory. injectPackage returns every site injected
+// across the package, for the caller to fold into the overall -manifest.
+func injectPackage(dir, root string) []SiteInfo {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, excludeGeneratedRuntime, parser.ParseComments)
+	if err != nil {
+		log.Fatalf("errorsmith: %s: %s", dir, err)
+	}
+
+	var allSites []SiteInfo
+	for _, pkg := range pkgs {
+		var pkgSites []SiteInfo
+		for filename, parsedFile := range pkg.Files {
+			content, err := ioutil.ReadFile(filename)
+			if err != nil {
+				log.Fatalf("errorsmith: %s: %s", filename, err)
+			}
+			formatted, sites, err := transformFile(fset, filename, content, parsedFile)
+			if err != nil {
+				failBroken(filename, formatted, err)
+			}
+			if *diffFlag {
+				fmt.Fprint(os.Stderr, unifiedDiff(filename, filename+" (errorsmith)", content, formatted))
+			}
+			if err := writePackageFile(root, filename, formatted); err != nil {
+				log.Fatalf("errorsmith: %s", err)
+			}
+			pkgSites = append(pkgSites, sites...)
+		}
+
+		runtimeDir := dir
+		if *output != "" {
+			runtimeDir = mirroredDir(root, dir)
+			if err := os.MkdirAll(runtimeDir, 0755); err != nil {
+				log.Fatalf("errorsmith: %s", err)
+			}
+		}
+		// writeRuntimeFile per package, with pkgSites rather than the
+		// directory's whole allSites: a dir can hold more than one package
+		// (foo plus foo_test is the standard case), and each needs its own
+		// runtime file declaring its own package clause.
+		if err := writeRuntimeFile(runtimeDir, pkg.Name, pkgSites); err != nil {
+			log.Fatalf("errorsmith: %s", err)
+		}
+		allSites = append(allSites, pkgSites...)
+	}
+	return allSites
+}
+
+// excludeGeneratedRuntime is a parser.ParseDir filter that skips
+// errorsmith's own generated runtime support files. Without it, re-running
+// directory mode over already-injected output picks up errorsmith_runtime_
+// <pkg>.go as an ordinary package member, which alreadyInjected doesn't
+// recognize (it carries no mangled fmt import), so it gets spliced with a
+// spurious import and keep-alive var of its own.
+func excludeGeneratedRuntime(info os.FileInfo) bool {
+	return !isGeneratedRuntimeFile(info.Name())
+}
+
+// writePackageFile writes the transformed content for filename according to
+// -o and -suffix: mirrored under the -o directory (so that filename's path
+// relative to root is preserved, and same-named files from different
+// packages under a ./... pattern don't collide) if set, alongside the
+// original with -suffix inserted before the .go extension if that's set
+// instead, or over the original file otherwise.
+func writePackageFile(root, filename string, content []byte) error {
+	target := filename
+	switch {
+	case *output != "":
+		target = filepath.Join(mirroredDir(root, filepath.Dir(filename)), filepath.Base(filename))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+	case *suffix != "":
+		ext := filepath.Ext(filename)
+		target = strings.TrimSuffix(filename, ext) + *suffix + ext
+	}
+	return ioutil.WriteFile(target, content, 0644)
+}
+
+// mirroredDir returns dir's path under -o, preserving its location relative
+// to root. It falls back to dir's own base name if dir isn't under root.
+func mirroredDir(root, dir string) string {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(dir)
+	}
+	return filepath.Join(*output, rel)
+}
+
+// expandPackagePattern turns a "dir/..." pattern into the list of
+// directories under dir that contain at least one .go file. Any other
+// pattern is returned unchanged as a single-element slice, to be resolved
+// as a plain file or directory by the caller.
+func expandPackagePattern(pattern string) []string {
+	if !strings.HasSuffix(pattern, "/...") {
+		return []string{pattern}
+	}
+
+	root := strings.TrimSuffix(pattern, "/...")
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && hasGoFiles(path) {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("errorsmith: %s: %s", pattern, err)
+	}
+	return dirs
+}
+
+// hasGoFiles reports whether dir directly contains any .go source file.
+func hasGoFiles(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".go") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var faultFlag = flag.String("fault", "error", "comma-separated fault kinds to inject at each ifnil site, each optionally suffixed with its own probability (e.g. \"error:0.2,panic:0.01,sleep,cancel,wrap\"); a kind with no probability uses -error-percent")
+var sleepDuration = flag.Duration("sleep-duration", 100*time.Millisecond, "duration to sleep for when the sleep fault kind fires")
+
+const (
+	timePackagePath = "time"
+	timePackageName = "_errorsmith_time_"
+
+	errorsPackagePath = "github.com/pkg/errors"
+	errorsPackageName = "_errorsmith_errors_"
+)
+
+// FaultSpec names one configured fault kind and its own probability.
+type FaultSpec struct {
+	Kind        string
+	Probability float64
+}
+
+// parseFaultSpecs parses -fault's "kind[:probability],..." syntax. A kind
+// with no ":probability" suffix gets defaultProbability.
+func parseFaultSpecs(flagValue string, defaultProbability float64) []FaultSpec {
+	var specs []FaultSpec
+	for _, part := range strings.Split(flagValue, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kind, prob := part, defaultProbability
+		if idx := strings.Index(part, ":"); idx >= 0 {
+			kind = part[:idx]
+			if p, err := strconv.ParseFloat(part[idx+1:], 64); err == nil {
+				prob = p
+			}
+		}
+		specs = append(specs, FaultSpec{Kind: kind, Probability: prob})
+	}
+	return specs
+}
+
+// hasFaultKind reports whether kind appears among specs.
+func hasFaultKind(specs []FaultSpec, kind string) bool {
+	for _, spec := range specs {
+		if spec.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultRegistry maps a fault kind name to a function that renders the Go
+// source fired when that kind's site faults. A render func returns "" to
+// decline firing at a site it doesn't apply to (e.g. wrap on a non-negated
+// branch, cancel with no context.Context in scope). Callers can add their
+// own kind by registering a function here — from a future -plugin, or by
+// linking errorsmith in as a library.
+var FaultRegistry = map[string]func(site SiteInfo) string{
+	"error":  renderErrorFault,
+	"panic":  renderPanicFault,
+	"sleep":  renderSleepFault,
+	"cancel": renderCancelFault,
+	"wrap":   renderWrapFault,
+}
+
+// renderErrorFault is errorsmith's original fault: log and substitute a
+// synthetic error for err.
+func renderErrorFault(site SiteInfo) string {
+	return fmt.Sprintf(`%s.Printf("injected error at %s:%d\n")
+err = %s.Errorf("injected error at %s:%d")`,
+		fmtPackageName, site.File, site.Line,
+		fmtPackageName, site.File, site.Line)
+}
+
+func renderPanicFault(site SiteInfo) string {
+	return fmt.Sprintf("panic(%q)", fmt.Sprintf("injected at %s:%d", site.File, site.Line))
+}
+
+func renderSleepFault(site SiteInfo) string {
+	return fmt.Sprintf("%s.Sleep(%d)", timePackageName, sleepDuration.Nanoseconds())
+}
+
+// renderCancelFault only applies where the enclosing function has a
+// context.Context parameter in scope: it derives a cancelable child of that
+// context, cancels it immediately, and surfaces the cancellation as err.
+func renderCancelFault(site SiteInfo) string {
+	if site.CtxVar == "" {
+		return ""
+	}
+	return fmt.Sprintf(`_errorsmithCtx, _errorsmithCancel := context.WithCancel(%s)
+_errorsmithCancel()
+err = _errorsmithCtx.Err()`, site.CtxVar)
+}
+
+// renderWrapFault only applies on an `err != nil` branch, where err already
+// holds a real error to wrap.
+func renderWrapFault(site SiteInfo) string {
+	if !site.Negated {
+		return ""
+	}
+	return fmt.Sprintf(`err = %s.Wrap(err, "injected wrap at %s:%d")`, errorsPackageName, site.File, site.Line)
+}
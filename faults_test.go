@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// wrapStmts places a fault kind's rendered statements, which aren't a
+// complete file on their own, inside a minimal function body so they can be
+// parsed and gofmt-checked in isolation.
+func wrapStmts(body string) string {
+	return fmt.Sprintf(`package p
+
+import "context"
+
+func f(ctx context.Context) error {
+	var err error
+	_ = ctx
+	_ = err
+	%s
+	return err
+}
+`, body)
+}
+
+// TestFaultRegistryRendersValidGo asserts every FaultRegistry entry either
+// declines a site (returns "") or renders source that parses and gofmts
+// cleanly, for both the sites it applies to and the sites it should decline.
+func TestFaultRegistryRendersValidGo(t *testing.T) {
+	withCtx := SiteInfo{ID: 1, File: "f.go", Line: 10, Func: "f", Probability: 0.1, CtxVar: "ctx"}
+	negated := withCtx
+	negated.Negated = true
+
+	tests := []struct {
+		kind    string
+		site    SiteInfo
+		applies bool
+	}{
+		{"error", withCtx, true},
+		{"panic", withCtx, true},
+		{"sleep", withCtx, true},
+		{"cancel", withCtx, true},
+		{"cancel", SiteInfo{}, false}, // no context.Context in scope
+		{"wrap", negated, true},
+		{"wrap", withCtx, false}, // not an `err != nil` branch
+	}
+
+	for _, tt := range tests {
+		render, ok := FaultRegistry[tt.kind]
+		if !ok {
+			t.Fatalf("no FaultRegistry entry for %q", tt.kind)
+		}
+
+		body := render(tt.site)
+		if applies := body != ""; applies != tt.applies {
+			t.Fatalf("%s.render(%+v) applies = %v, want %v", tt.kind, tt.site, applies, tt.applies)
+		}
+		if body == "" {
+			continue
+		}
+
+		src := wrapStmts(body)
+		if _, err := parser.ParseFile(token.NewFileSet(), "", src, 0); err != nil {
+			t.Fatalf("%s render produced unparseable Go: %s\n%s", tt.kind, err, src)
+		}
+		if _, err := format.Source([]byte(src)); err != nil {
+			t.Fatalf("%s render produced source gofmt rejects: %s\n%s", tt.kind, err, src)
+		}
+	}
+}
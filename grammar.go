@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+var modeFlag = flag.String("mode", "ifnil", "comma-separated list of injection grammars to enable: ifnil (if err == nil/!= nil), init (if err := f(); err == nil/!= nil), assign (x, err := foo())")
+
+const (
+	// maybeFaultFuncName is the generated per-package helper that the init
+	// and assign grammars route an err value through: it returns either
+	// the original err or a synthetic fault, depending on the site's id.
+	maybeFaultFuncName = "_errorsmith_maybeFault"
+
+	pragmaInject = "errorsmith:inject"
+	pragmaSkip   = "errorsmith:skip"
+)
+
+// parseModes turns -mode's comma-separated list into a lookup set.
+func parseModes(flagValue string) map[string]bool {
+	modes := make(map[string]bool)
+	for _, mode := range strings.Split(flagValue, ",") {
+		mode = strings.TrimSpace(mode)
+		if mode != "" {
+			modes[mode] = true
+		}
+	}
+	return modes
+}
+
+// errNilIdent reports whether cond has the form `err == nil` or
+// `err != nil`, returning the err identifier if so.
+func errNilIdent(cond ast.Expr) (*ast.Ident, bool) {
+	e, ok := cond.(*ast.BinaryExpr)
+	if !ok || (e.Op != token.EQL && e.Op != token.NEQ) {
+		return nil, false
+	}
+	x, ok := e.X.(*ast.Ident)
+	if !ok || x.Name != "err" {
+		return nil, false
+	}
+	y, ok := e.Y.(*ast.Ident)
+	if !ok || y.Name != "nil" {
+		return nil, false
+	}
+	return x, true
+}
+
+// isErrAssign reports whether n is a multi-return, short-variable-declared
+// call site whose last result is named err, e.g. `x, err := foo()`.
+func isErrAssign(n *ast.AssignStmt) bool {
+	if n.Tok != token.DEFINE || len(n.Lhs) < 2 || len(n.Rhs) != 1 {
+		return false
+	}
+	if _, ok := n.Rhs[0].(*ast.CallExpr); !ok {
+		return false
+	}
+	last, ok := n.Lhs[len(n.Lhs)-1].(*ast.Ident)
+	return ok && last.Name == "err"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// mustTransform runs transformFile over src under mode, asserting that the
+// result is itself valid Go (transformFile already re-parses its own output
+// via validateSource, so a non-nil error here means that check failed), and
+// returns the sites it injected alongside the transformed source.
+func mustTransform(t *testing.T, name, src, mode string) ([]byte, []SiteInfo) {
+	t.Helper()
+
+	origMode := *modeFlag
+	*modeFlag = mode
+	defer func() { *modeFlag = origMode }()
+
+	fset := token.NewFileSet()
+	parsed, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("test input %s doesn't parse: %s", name, err)
+	}
+	out, sites, err := transformFile(fset, name, []byte(src), parsed)
+	if err != nil {
+		t.Fatalf("transformFile(mode=%q): %s", mode, err)
+	}
+	return out, sites
+}
+
+// TestGrammarModes exercises each injection grammar (and a couple of
+// combinations known to interact) against real source, asserting not just
+// that the injected output re-parses (validateSource already guarantees
+// that) but that the grammar under test actually fired: it recorded the
+// expected number of sites and spliced in the marker call that grammar uses.
+func TestGrammarModes(t *testing.T) {
+	tests := []struct {
+		name, mode, src string
+		wantSites       int
+		wantMarker      string // substring that must appear in the output if wantSites > 0.
+	}{
+		{
+			name: "ifnil",
+			mode: "ifnil",
+			src: `package p
+
+func f() error {
+	err := g()
+	if err == nil {
+		return nil
+	}
+	return err
+}
+
+func g() error { return nil }
+`,
+			wantSites:  1,
+			wantMarker: shouldFaultFuncName + "(",
+		},
+		{
+			name: "ifnil else-if chain",
+			mode: "ifnil",
+			src: `package p
+
+func f() error {
+	err := g()
+	if err == nil {
+		return nil
+	} else if h() {
+		return err
+	}
+	return err
+}
+
+func g() error { return nil }
+func h() bool  { return false }
+`,
+			wantSites:  1,
+			wantMarker: shouldFaultFuncName + "(",
+		},
+		{
+			name: "init single-return",
+			mode: "init",
+			src: `package p
+
+func f() error {
+	if err := g(); err == nil {
+		return nil
+	}
+	return nil
+}
+
+func g() error { return nil }
+`,
+			wantSites:  1,
+			wantMarker: maybeFaultFuncName + "(",
+		},
+		{
+			name: "assign",
+			mode: "assign",
+			src: `package p
+
+func f() (int, error) {
+	x, err := g()
+	if err != nil {
+		return 0, err
+	}
+	return x, nil
+}
+
+func g() (int, error) { return 0, nil }
+`,
+			wantSites:  1,
+			wantMarker: maybeFaultFuncName + "(",
+		},
+		{
+			// Regression test: a multi-return if-init is declined by both
+			// the ifnil grammar (it has an init clause) and the init
+			// grammar (init isn't a single-LHS `err := f()`). The assign
+			// grammar used to mishandle it when enabled alongside: it
+			// spliced a following statement into the "init; cond" header
+			// instead of declining too. None of the three grammars should
+			// fire here, so no site should be recorded and no maybeFault
+			// call should appear anywhere in the output.
+			name: "multi-return if-init with assign also enabled",
+			mode: "ifnil,init,assign",
+			src: `package p
+
+func f() (int, error) {
+	if x, err := g(); err == nil {
+		return x, nil
+	} else {
+		return 0, err
+	}
+}
+
+func g() (int, error) { return 0, nil }
+`,
+			wantSites: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			out, sites := mustTransform(t, tt.name+".go", tt.src, tt.mode)
+			if len(sites) != tt.wantSites {
+				t.Fatalf("got %d sites, want %d\n%s", len(sites), tt.wantSites, out)
+			}
+			if tt.wantMarker != "" && !strings.Contains(string(out), tt.wantMarker) {
+				t.Fatalf("output missing marker %q\n%s", tt.wantMarker, out)
+			}
+			if tt.wantSites == 0 && strings.Contains(string(out), maybeFaultFuncName+"(") {
+				t.Fatalf("output unexpectedly contains %s(\n%s", maybeFaultFuncName, out)
+			}
+		})
+	}
+}
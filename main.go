@@ -11,6 +11,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -20,6 +22,10 @@ const usageMessage = "" +
 
 Randomly inject errors into a Go file:
     errorsmith file.go
+
+Randomly inject errors into every file of a package:
+    errorsmith somedir/
+    errorsmith somedir/...
 `
 
 func usage() {
@@ -29,13 +35,11 @@ func usage() {
 	os.Exit(2)
 }
 
-var output = flag.String("o", "", "file for output; default: stdout")
+var output = flag.String("o", "", "file for output in single-file mode, or output directory in package mode; default: stdout (single-file) or in place (package mode)")
+var suffix = flag.String("suffix", "", "in package mode, suffix inserted before the .go extension of each output file (e.g. \"_injected\" produces foo_injected.go) instead of overwriting the original; ignored if -o is set")
 var errorPercent = flag.Float64("error-percent", 0.1, "percent error likelihood")
 
 const (
-	randPackagePath = "math/rand"
-	randPackageName = "_errorsmith_rand_"
-
 	fmtPackagePath = "fmt"
 	fmtPackageName = "_errorsmith_fmt_"
 )
@@ -48,8 +52,28 @@ func main() {
 	if flag.NFlag() == 0 && flag.NArg() == 0 {
 		flag.Usage()
 	}
-	injectErrors(flag.Arg(0))
-	return
+
+	// root is the base that -o's output tree mirrors each package
+	// directory's path under: the ./... pattern trimmed of its suffix, or
+	// (for a single directory/file argument) the argument itself.
+	root := strings.TrimSuffix(flag.Arg(0), "/...")
+
+	var allSites []SiteInfo
+	for _, target := range expandPackagePattern(flag.Arg(0)) {
+		info, err := os.Stat(target)
+		if err != nil {
+			log.Fatalf("errorsmith: %s", err)
+		}
+		if info.IsDir() {
+			allSites = append(allSites, injectPackage(target, root)...)
+		} else {
+			allSites = append(allSites, injectErrors(target)...)
+		}
+	}
+
+	if err := writeManifest(allSites); err != nil {
+		log.Fatalf("errorsmith: %s", err)
+	}
 }
 
 // File is a wrapper for the state of a file used in the parser.
@@ -60,6 +84,109 @@ type File struct {
 	astFile *ast.File
 	content []byte
 	edit    *Buffer
+
+	modes    map[string]bool // injection grammars enabled by -mode.
+	faults   []FaultSpec     // fault kinds enabled by -fault, for the ifnil grammar.
+	comments ast.CommentMap  // source comments, for the errorsmith: pragmas.
+
+	frames       []funcFrame    // enclosing functions, innermost last.
+	siteCounters map[string]int // per-function injection site counter.
+	sites        []SiteInfo     // every site injected into this file so far.
+
+	declinedInit ast.Stmt // an if's init clause injectIfInit didn't rewrite; see the AssignStmt case.
+}
+
+// funcFrame tracks one level of function nesting while walking the AST.
+type funcFrame struct {
+	name   string
+	skip   bool   // set by an //errorsmith:skip on the FuncDecl itself.
+	ctxVar string // name of a context.Context parameter, if this func has one.
+}
+
+// currentFunc returns the name of the function currently being walked, or
+// "<package>" if we're outside any function body.
+func (f *File) currentFunc() string {
+	if len(f.frames) == 0 {
+		return "<package>"
+	}
+	return f.frames[len(f.frames)-1].name
+}
+
+// currentCtxVar returns the name of the innermost enclosing function's
+// context.Context parameter, or "" if it doesn't have one.
+func (f *File) currentCtxVar() string {
+	if len(f.frames) == 0 {
+		return ""
+	}
+	return f.frames[len(f.frames)-1].ctxVar
+}
+
+// contextParamName returns the name of fn's first context.Context
+// parameter, or "" if it doesn't have one.
+func contextParamName(fn *ast.FuncDecl) string {
+	if fn.Type.Params == nil {
+		return ""
+	}
+	for _, field := range fn.Type.Params.List {
+		sel, ok := field.Type.(*ast.SelectorExpr)
+		if !ok {
+			continue
+		}
+		pkg, ok := sel.X.(*ast.Ident)
+		if !ok || pkg.Name != "context" || sel.Sel.Name != "Context" {
+			continue
+		}
+		if len(field.Names) > 0 {
+			return field.Names[0].Name
+		}
+	}
+	return ""
+}
+
+// funcSkip reports whether the innermost enclosing function carries an
+// //errorsmith:skip pragma.
+func (f *File) funcSkip() bool {
+	if len(f.frames) == 0 {
+		return false
+	}
+	return f.frames[len(f.frames)-1].skip
+}
+
+// hasPragma reports whether node has a comment containing pragma, e.g.
+// "errorsmith:skip" or "errorsmith:inject".
+func (f *File) hasPragma(node ast.Node, pragma string) bool {
+	for _, cg := range f.comments[node] {
+		if strings.Contains(cg.Text(), pragma) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSite finishes filling in site (computing its ID from pos and the
+// current function's site counter, and its file/line/func), appends it to
+// f.sites, and returns the completed SiteInfo.
+func (f *File) recordSite(pos token.Pos, site SiteInfo) SiteInfo {
+	funcName := f.currentFunc()
+	f.siteCounters[funcName]++
+	site.File = f.name
+	site.Line = f.fset.Position(pos).Line
+	site.Func = funcName
+	site.ID = siteID(f.name, site.Line, f.fset.Position(pos).Column, funcName, f.siteCounters[funcName])
+	f.sites = append(f.sites, site)
+	return site
+}
+
+// recordErrorSite is a convenience wrapper around recordSite for the init
+// and assign grammars, which only ever substitute a synthetic error for err
+// (via _errorsmith_maybeFault) rather than drawing on the FaultRegistry.
+func (f *File) recordErrorSite(pos token.Pos, snippet string) uint64 {
+	return f.recordSite(pos, SiteInfo{Probability: *errorPercent / 100, Snippet: snippet}).ID
+}
+
+// sourceText returns the original source text spanning [start, end).
+func (f *File) sourceText(start, end token.Pos) string {
+	return string(f.content[f.offset(start):f.offset(end)])
 }
 
 // findText finds text in the original source, starting at pos.
@@ -102,33 +229,64 @@ func (f *File) findText(pos token.Pos, text string) int {
 func (f *File) Visit(node ast.Node) ast.Visitor {
 	switch n := node.(type) {
 	case *ast.ImportSpec:
-	case *ast.IfStmt:
-		if n.Init != nil {
-			ast.Walk(f, n.Init)
+	case *ast.FuncDecl:
+		name := "init"
+		if n.Name != nil {
+			name = n.Name.Name
 		}
-		if n.Init == nil {
-			// Can't inject faults into auto-initialized nils yet.
-			if e, ok := n.Cond.(*ast.BinaryExpr); ok {
-				if x, ok := e.X.(*ast.Ident); ok && x.Name == "err" {
-					if e.Op == token.EQL || e.Op == token.NEQ {
-						if y, ok := e.Y.(*ast.Ident); ok && y.Name == "nil" {
-							// We found an if of form err == nil. Inject a fault!
-							f.edit.Insert(f.offset(n.Pos()),
-								fmt.Sprintf(`if %s.Int() %% %d == 0 {
-    %s.Printf("injected error at %s:%d\n")
-    err = %s.Errorf("injected error at %s:%d")
-}
-`, randPackageName, int(100/(*errorPercent)),
-									fmtPackageName,
-									f.name, f.fset.Position(n.Pos()).Line,
-									fmtPackageName,
-									f.name, f.fset.Position(n.Pos()).Line,
-								))
-						}
-					}
-				}
+		f.frames = append(f.frames, funcFrame{name: name, skip: f.hasPragma(n, pragmaSkip), ctxVar: contextParamName(n)})
+		if n.Body != nil {
+			ast.Walk(f, n.Body)
+		}
+		f.frames = f.frames[:len(f.frames)-1]
+		return nil
+	case *ast.AssignStmt:
+		// An if's init clause that injectIfInit didn't rewrite (e.g. a
+		// multi-return `if x, err := f(); err == nil`) reaches here via the
+		// IfStmt case's ast.Walk(f, n.Init). The assign grammar below
+		// splices a following statement, which would land inside the "init;
+		// cond" header instead of after it, so decline it there too. Clear
+		// declinedInit once checked so a func literal nested in this
+		// statement's Rhs isn't also wrongly suppressed.
+		declinedInit := n == f.declinedInit
+		f.declinedInit = nil
+		skip := f.funcSkip() || f.hasPragma(n, pragmaSkip)
+		inject := f.hasPragma(n, pragmaInject)
+		if !declinedInit && !skip && (f.modes["assign"] || inject) && isErrAssign(n) {
+			// We found a multi-return call site like `x, err := foo()`.
+			// Overwrite err immediately afterwards with a probability check.
+			id := f.recordErrorSite(n.Pos(), f.sourceText(n.Pos(), n.End()))
+			f.edit.Insert(f.offset(n.End()),
+				fmt.Sprintf("\nerr = %s(%d, err)", maybeFaultFuncName, id))
+		}
+		for _, rhs := range n.Rhs {
+			ast.Walk(f, rhs)
+		}
+		return nil
+	case *ast.IfStmt:
+		skip := f.funcSkip() || f.hasPragma(n, pragmaSkip)
+		inject := f.hasPragma(n, pragmaInject)
+		handledInit := false
+		if _, ok := errNilIdent(n.Cond); ok && !skip {
+			switch {
+			case n.Init == nil && (f.modes["ifnil"] || inject):
+				// We found an if of form err == nil. Inject a fault!
+				f.injectIfNil(n)
+			case n.Init != nil && (f.modes["init"] || inject):
+				// We found an `if err := f(); err == nil` form. Inject a
+				// fault by rewriting the init's call to pass through
+				// _errorsmith_maybeFault.
+				handledInit = f.injectIfInit(n)
 			}
 		}
+		if n.Init != nil && !handledInit {
+			// injectIfInit didn't rewrite this init (most commonly a
+			// multi-return form it declines, or the init grammar isn't
+			// enabled); mark it so the AssignStmt case below
+			// knows not to splice a following statement into the header.
+			f.declinedInit = n.Init
+			ast.Walk(f, n.Init)
+		}
 		ast.Walk(f, n.Cond)
 		ast.Walk(f, n.Body)
 		if n.Else == nil {
@@ -177,12 +335,70 @@ func (f *File) Visit(node ast.Node) ast.Visitor {
 	return f
 }
 
+// injectIfNil inserts one fault-injecting if-block per enabled -fault kind
+// immediately before an `if err == nil` / `if err != nil` statement with no
+// init clause. Each kind gets its own site, so each fires independently
+// according to its own probability.
+func (f *File) injectIfNil(n *ast.IfStmt) {
+	negated := n.Cond.(*ast.BinaryExpr).Op == token.NEQ
+	snippet := "if " + f.sourceText(n.Cond.Pos(), n.Cond.End())
+
+	var blocks bytes.Buffer
+	for _, spec := range f.faults {
+		render, ok := FaultRegistry[spec.Kind]
+		if !ok {
+			continue
+		}
+		site := f.recordSite(n.Pos(), SiteInfo{
+			Probability: spec.Probability,
+			Snippet:     snippet,
+			Negated:     negated,
+			CtxVar:      f.currentCtxVar(),
+		})
+		body := render(site)
+		if body == "" {
+			// This fault kind doesn't apply at this site; drop the site we
+			// just recorded so it doesn't show up unused in the manifest.
+			f.sites = f.sites[:len(f.sites)-1]
+			continue
+		}
+		fmt.Fprintf(&blocks, "if %s(%d) {\n%s\n}\n", shouldFaultFuncName, site.ID, body)
+	}
+	f.edit.Insert(f.offset(n.Pos()), blocks.String())
+}
+
+// injectIfInit handles `if err := f(); err == nil` style statements. The
+// init clause can only ever hold that one statement, so there's no room to
+// splice an extra one in; instead we wrap the init's call expression so its
+// result passes through _errorsmith_maybeFault, which leaves err's scoping
+// exactly as the programmer wrote it. It reports whether it made a change.
+func (f *File) injectIfInit(n *ast.IfStmt) bool {
+	assign, ok := n.Init.(*ast.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return false
+	}
+	if ident, ok := assign.Lhs[0].(*ast.Ident); !ok || ident.Name != "err" {
+		return false
+	}
+
+	snippet := "if " + f.sourceText(n.Init.Pos(), n.Init.End()) + "; " + f.sourceText(n.Cond.Pos(), n.Cond.End())
+	id := f.recordErrorSite(n.Init.Pos(), snippet)
+	rhs := assign.Rhs[0]
+	f.edit.Insert(f.offset(rhs.Pos()), fmt.Sprintf("%s(%d, ", maybeFaultFuncName, id))
+	f.edit.Insert(f.offset(rhs.End()), ")")
+	return true
+}
+
 // offset translates a token position into a 0-indexed byte offset.
 func (f *File) offset(pos token.Pos) int {
 	return f.fset.Position(pos).Offset
 }
 
-func injectErrors(name string) {
+// injectErrors transforms a single file named name, writes the result to
+// stdout (or to *output if it was set), and writes out its runtime support
+// file alongside the original. It returns every site injected into name,
+// for the caller to fold into the overall -manifest.
+func injectErrors(name string) []SiteInfo {
 	fset := token.NewFileSet()
 	content, err := ioutil.ReadFile(name)
 	if err != nil {
@@ -193,45 +409,99 @@ func injectErrors(name string) {
 		log.Fatalf("errorsmith: %s: %s", name, err)
 	}
 
-	file := &File{
-		fset:    fset,
-		name:    name,
-		content: content,
-		edit:    NewBuffer(content),
-		astFile: parsedFile,
-	}
-	file.edit.Insert(file.offset(file.astFile.Name.End()),
-		fmt.Sprintf(`
-import %s %q
-import %s %q
-`,
-			randPackageName, randPackagePath,
-			fmtPackageName, fmtPackagePath,
-		))
+	formatted, sites, err := transformFile(fset, name, content, parsedFile)
+	if err != nil {
+		failBroken(name, formatted, err)
+	}
 
-	ast.Walk(file, file.astFile)
-	newContent := file.edit.Bytes()
-	newContent = append(newContent, []byte(fmt.Sprintf("\nvar _ = %s.Int", randPackageName))...)
-	newContent = append(newContent, []byte(fmt.Sprintf("\nvar _ = %s.Printf", fmtPackageName))...)
+	if *diffFlag {
+		fmt.Fprint(os.Stderr, unifiedDiff(name, name+" (errorsmith)", content, formatted))
+	}
 
 	fd := os.Stdout
 	if *output != "" {
-		var err error
-		fd, err = os.Create(*output)
-		if err != nil {
-			log.Fatalf("errorsmith: %s", err)
+		var ferr error
+		fd, ferr = os.Create(*output)
+		if ferr != nil {
+			log.Fatalf("errorsmith: %s", ferr)
 		}
 	}
+	fd.Write(formatted)
+
+	if err := writeRuntimeFile(filepath.Dir(name), parsedFile.Name.Name, sites); err != nil {
+		log.Fatalf("errorsmith: %s", err)
+	}
+	return sites
+}
+
+// transformFile runs the fault-injecting AST walk over parsedFile and
+// returns the formatted result plus every site it injected. If parsedFile
+// already carries errorsmith's sentinel import, it is assumed to have been
+// injected already and is returned unmodified, so that re-running
+// errorsmith over its own output is a no-op instead of injecting a second
+// layer of faults.
+func transformFile(fset *token.FileSet, name string, content []byte, parsedFile *ast.File) ([]byte, []SiteInfo, error) {
+	if alreadyInjected(parsedFile) {
+		return content, nil, nil
+	}
+
+	faultSpecs := parseFaultSpecs(*faultFlag, *errorPercent/100)
+	needsTime := hasFaultKind(faultSpecs, "sleep")
+	needsErrorsPkg := hasFaultKind(faultSpecs, "wrap")
+
+	file := &File{
+		fset:         fset,
+		name:         name,
+		content:      content,
+		edit:         NewBuffer(content),
+		astFile:      parsedFile,
+		modes:        parseModes(*modeFlag),
+		faults:       faultSpecs,
+		comments:     ast.NewCommentMap(fset, parsedFile, parsedFile.Comments),
+		siteCounters: make(map[string]int),
+	}
+
+	var imports bytes.Buffer
+	fmt.Fprintf(&imports, "\nimport %s %q\n", fmtPackageName, fmtPackagePath)
+	if needsTime {
+		fmt.Fprintf(&imports, "import %s %q\n", timePackageName, timePackagePath)
+	}
+	if needsErrorsPkg {
+		fmt.Fprintf(&imports, "import %s %q\n", errorsPackageName, errorsPackagePath)
+	}
+	file.edit.Insert(file.offset(file.astFile.Name.End()), imports.String())
+
+	ast.Walk(file, file.astFile)
+	newContent := file.edit.Bytes()
+	newContent = append(newContent, []byte(fmt.Sprintf("\nvar _ = %s.Printf", fmtPackageName))...)
+	if needsTime {
+		newContent = append(newContent, []byte(fmt.Sprintf("\nvar _ = %s.Sleep", timePackageName))...)
+	}
+	if needsErrorsPkg {
+		newContent = append(newContent, []byte(fmt.Sprintf("\nvar _ = %s.Wrap", errorsPackageName))...)
+	}
 
 	formatted, err := format.Source(newContent)
 	if err != nil {
 		// Write out incorrect source for easier debugging.
-		formatted = newContent
-		err = errors.Wrap(err, "Code formatting failed with Go parse error")
+		return newContent, file.sites, errors.Wrap(err, "Code formatting failed with Go parse error")
 	}
-	fd.Write(formatted)
+	if err := validateSource(name, formatted); err != nil {
+		return formatted, file.sites, err
+	}
+	return formatted, file.sites, nil
+}
 
-	if err != nil {
-		log.Fatalf("errorsmith: %s", err)
+// alreadyInjected reports whether f imports errorsmith's mangled fmt
+// package, which it only ever does as a result of a prior injection pass.
+func alreadyInjected(f *ast.File) bool {
+	for _, imp := range f.Imports {
+		if imp.Name == nil {
+			continue
+		}
+		if imp.Name.Name == fmtPackageName {
+			return true
+		}
 	}
+	return false
 }
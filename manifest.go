@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var manifestPath = flag.String("manifest", "", "file to write a JSON manifest of every injection site to; lets a specific run be reproduced or have individual sites disabled via ERRORSMITH_DISABLE")
+
+// runtimeFilePrefix names the generated per-package runtime support file:
+// errorsmith_runtime_<pkg>.go. isGeneratedRuntimeFile uses the same prefix
+// to recognize and skip these files on a later pass.
+const runtimeFilePrefix = "errorsmith_runtime_"
+
+// SiteInfo describes a single fault-injection site: enough to reproduce it
+// (ID, probability), find it (file, line, func), and review it at a glance
+// (the source of the if statement it was inserted into). Negated and CtxVar
+// exist so a FaultRegistry entry can tell whether its fault kind applies at
+// this particular site.
+type SiteInfo struct {
+	ID          uint64  `json:"id"`
+	File        string  `json:"file"`
+	Line        int     `json:"line"`
+	Func        string  `json:"func"`
+	Probability float64 `json:"probability"`
+	Snippet     string  `json:"snippet"`
+	Negated     bool    `json:"negated,omitempty"` // true for an `err != nil` branch.
+	CtxVar      string  `json:"ctxVar,omitempty"`  // name of an in-scope context.Context param, if any.
+}
+
+// writeManifest writes sites as JSON to *manifestPath, if that flag was set.
+func writeManifest(sites []SiteInfo) error {
+	if *manifestPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(sites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*manifestPath, data, 0644)
+}
+
+// writeRuntimeFile emits the generated support file that backs
+// _errorsmith_shouldFault for a package: a map from site ID to fault
+// probability, and an ERRORSMITH_DISABLE-driven override. It's a no-op when
+// sites is empty, since there's then nothing for the function to decide.
+// The file is named after pkgName so that a directory holding more than one
+// package (e.g. foo plus foo_test) gets one runtime file per package instead
+// of the last one processed clobbering the rest. Like the transformed source
+// itself, its content is re-parsed before being written out, so a broken
+// template doesn't get shipped as silently as it once did.
+func writeRuntimeFile(dir, pkgName string, sites []SiteInfo) error {
+	if len(sites) == 0 {
+		return nil
+	}
+	path := filepath.Join(dir, runtimeFilePrefix+pkgName+".go")
+	content := runtimeSource(pkgName, sites)
+	if err := validateSource(path, content); err != nil {
+		failBroken(path, content, err)
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// isGeneratedRuntimeFile reports whether name is a runtime support file
+// writeRuntimeFile produced, by its errorsmith_runtime_<pkg>.go naming
+// pattern.
+func isGeneratedRuntimeFile(name string) bool {
+	return strings.HasPrefix(name, runtimeFilePrefix) && strings.HasSuffix(name, ".go")
+}
+
+// runtimeSource renders the generated runtime support file's source for
+// pkgName. The fault decision is computed from an FNV hash of -seed and the
+// site ID, entirely within the generated file, so the instrumented package
+// never needs to import errorsmith itself.
+func runtimeSource(pkgName string, sites []SiteInfo) []byte {
+	var probs bytes.Buffer
+	for _, s := range sites {
+		fmt.Fprintf(&probs, "\t%d: %v,\n", s.ID, s.Probability)
+	}
+	return []byte(fmt.Sprintf(`// Code generated by errorsmith. DO NOT EDIT.
+
+package %s
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const _errorsmithSeed = %d
+
+var _errorsmithSiteProbability = map[uint64]float64{
+%s}
+
+var _errorsmithDisabled = func() map[uint64]bool {
+	m := make(map[uint64]bool)
+	for _, s := range strings.Split(os.Getenv("ERRORSMITH_DISABLE"), ",") {
+		if s == "" {
+			continue
+		}
+		if id, err := strconv.ParseUint(s, 10, 64); err == nil {
+			m[id] = true
+		}
+	}
+	return m
+}()
+
+// %s deterministically decides whether site id should fault: the same
+// -seed always faults exactly the same sites, which is what makes a run
+// reproducible. ERRORSMITH_DISABLE=<id>,<id> forces individual sites off.
+func %s(id uint64) bool {
+	if _errorsmithDisabled[id] {
+		return false
+	}
+	p, ok := _errorsmithSiteProbability[id]
+	if !ok {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(_errorsmithSeed, 10)))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.FormatUint(id, 10)))
+	return float64(h.Sum64()%%1000000)/1000000 < p
+}
+
+// %s routes an err value through %s: it returns a synthetic fault in
+// place of err when site id should fault, and err unchanged otherwise.
+func %s(id uint64, err error) error {
+	if !%s(id) {
+		return err
+	}
+	fmt.Printf("injected error at site %%d\n", id)
+	return fmt.Errorf("injected error at site %%d", id)
+}
+`, pkgName, *seed, probs.String(), shouldFaultFuncName, shouldFaultFuncName,
+		maybeFaultFuncName, shouldFaultFuncName, maybeFaultFuncName, shouldFaultFuncName))
+}
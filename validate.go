@@ -0,0 +1,32 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// validateSource re-parses a transformed file's formatted output to
+// guarantee it's syntactically valid Go. This is the same "parse, print,
+// re-parse" self-check gofmt and go/printer use on themselves; it exists to
+// catch errorsmith's own text-edit bugs (e.g. broken positions from the
+// else-chain rewrite) instead of silently shipping broken source.
+func validateSource(name string, formatted []byte) error {
+	if _, err := parser.ParseFile(token.NewFileSet(), name, formatted, parser.ParseComments); err != nil {
+		return errors.Wrap(err, "errorsmith produced unparseable Go source")
+	}
+	return nil
+}
+
+// failBroken writes content to name's .errorsmith.broken sidecar for
+// inspection, then exits non-zero citing err. It never returns.
+func failBroken(name string, content []byte, err error) {
+	brokenPath := name + ".errorsmith.broken"
+	if werr := ioutil.WriteFile(brokenPath, content, 0644); werr != nil {
+		log.Fatalf("errorsmith: %s: %s", name, werr)
+	}
+	log.Fatalf("errorsmith: %s: %s (broken output retained at %s)", name, err, brokenPath)
+}